@@ -1,14 +1,43 @@
 package snapshot
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/Microsoft/hcsshim"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/mount"
 	"github.com/pkg/errors"
 )
 
+// ScratchLayerDir is the directory under which read-only Windows overlay
+// mounts create their throwaway scratch layers. It defaults to the OS temp
+// directory; callers that know buildkit's state dir should set this once
+// at startup so scratch layers land on the same volume as everything else
+// buildkit manages.
+var ScratchLayerDir string
+
+// defaultScratchLayerSize mirrors the platform default VHD size used when
+// a read-only mount's "size=" option doesn't override it.
+const defaultScratchLayerSize = 20 * 1024 * 1024 * 1024 // 20 GB
+
+// parentLayerPathsFlag is the mount option prefix used by the windows
+// snapshotter to carry the ordered (lowest to highest) list of parent
+// layer paths for a "windows-layer" mount, JSON-encoded as a []string.
+const parentLayerPathsFlag = "parentLayerPaths="
+
+// mountLockFile marks a layer directory as having an in-progress or
+// crashed activation, so Unmount can tell a real teardown from a no-op
+// even after the process that called Mount is long gone.
+const mountLockFile = "buildkit-mount.lock"
+
 func (lm *localMounter) Mount() (string, error) {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
@@ -22,8 +51,20 @@ func (lm *localMounter) Mount() (string, error) {
 		lm.release = release
 	}
 
-	// Windows can only mount a single mount at a given location.
-	// Parent layers are carried in Options, opaquely to localMounter.
+	if len(lm.mounts) == 0 {
+		return "", errors.New("no mounts to mount")
+	}
+
+	// A chain of windows-layer mounts is how the windows snapshotter hands
+	// us a multi-layer image: one entry per parent layer, ordered lowest to
+	// highest, with the last entry being the top (writable) layer. Compose
+	// them into a single merged view below instead of mounting each one.
+	if isWindowsLayerChain(lm.mounts) {
+		return lm.mountWindowsLayer(lm.mounts)
+	}
+
+	// Anything else, Windows can only mount a single mount at a given
+	// location.
 	if len(lm.mounts) != 1 {
 		return "", errors.Wrapf(errdefs.ErrNotImplemented, "request to mount %d layers, only 1 is supported", len(lm.mounts))
 	}
@@ -32,15 +73,34 @@ func (lm *localMounter) Mount() (string, error) {
 
 	if m.Type == "bind" || m.Type == "rbind" {
 		ro := false
+		size := int64(defaultScratchLayerSize)
 		for _, opt := range m.Options {
-			if opt == "ro" {
+			switch {
+			case opt == "ro":
 				ro = true
-				break
+			case strings.HasPrefix(opt, "size="):
+				s, err := strconv.ParseInt(strings.TrimPrefix(opt, "size="), 10, 64)
+				if err != nil {
+					return "", errors.Wrapf(err, "invalid size option %q", opt)
+				}
+				size = s
 			}
 		}
 		if !ro {
 			return m.Source, nil
 		}
+
+		token := scratchTokenFromOptions(m.Options)
+		if token == "" {
+			var err error
+			token, err = newScratchToken()
+			if err != nil {
+				return "", errors.Wrap(err, "failed to generate scratch layer token")
+			}
+			lm.mounts[0].Options = append(lm.mounts[0].Options, scratchTokenFlag+token)
+		}
+
+		return lm.mountReadOnlyLayer(m.Source, size, token)
 	}
 
 	dir, err := ioutil.TempDir("", "buildkit-mount")
@@ -56,15 +116,267 @@ func (lm *localMounter) Mount() (string, error) {
 	return lm.target, nil
 }
 
+// isWindowsLayerChain reports whether mounts is entirely composed of
+// windows-layer entries, i.e. an ordered (lowest to highest) parent layer
+// chain rather than a single bind-style mount.
+func isWindowsLayerChain(mounts []mount.Mount) bool {
+	if len(mounts) == 0 {
+		return false
+	}
+	for _, m := range mounts {
+		if m.Type != "windows-layer" {
+			return false
+		}
+	}
+	return true
+}
+
+// mountWindowsLayer composes a UnionFS/CimFS view of the top (last) entry
+// in mounts on top of its parents, so a caller can read/write inside the
+// merged view of a multi-layer Windows image. The parent chain may arrive
+// either as the preceding entries in mounts, ordered lowest to highest, or
+// JSON-encoded in the top entry's Options (or both, in which case the
+// Options-encoded parents are treated as lower still).
+func (lm *localMounter) mountWindowsLayer(mounts []mount.Mount) (string, error) {
+	top := mounts[len(mounts)-1]
+
+	parentLayerPaths, err := parentLayerPathsFromOptions(top.Options)
+	if err != nil {
+		return "", err
+	}
+
+	if len(mounts) > 1 {
+		chainParents := make([]string, 0, len(mounts)-1)
+		for _, m := range mounts[:len(mounts)-1] {
+			chainParents = append(chainParents, m.Source)
+		}
+		parentLayerPaths = append(parentLayerPaths, chainParents...)
+	}
+
+	di := hcsshim.DriverInfo{}
+
+	if err := activateAndPrepareLayer(di, top.Source, parentLayerPaths); err != nil {
+		return "", err
+	}
+
+	mountPath, err := hcsshim.GetLayerMountPath(di, top.Source)
+	if err != nil {
+		unmountWindowsLayer(top.Source)
+		return "", errors.Wrapf(err, "failed to get mount path for layer %s", top.Source)
+	}
+
+	lm.target = mountPath
+	return lm.target, nil
+}
+
+// mountReadOnlyLayer gives a read-only view of source by activating a
+// throwaway scratch layer parented on it, so callers like llbsolver cache
+// probes or a Dockerfile COPY --from get a usable path without being able
+// to mutate the committed layer underneath. token distinguishes this
+// mount's scratch layer from any other concurrent read-only mount of the
+// same source, so two callers probing the same committed layer at once
+// don't race each other's CreateScratchLayer/ActivateLayer/DestroyLayer
+// calls.
+func (lm *localMounter) mountReadOnlyLayer(source string, size int64, token string) (string, error) {
+	scratchDir := readOnlyScratchLayerPath(source, token)
+	if err := os.MkdirAll(filepath.Dir(scratchDir), 0700); err != nil {
+		return "", errors.Wrap(err, "failed to create scratch layer parent dir")
+	}
+
+	di := hcsshim.DriverInfo{}
+
+	if err := hcsshim.CreateScratchLayer(di, scratchDir, []string{source}); err != nil {
+		return "", errors.Wrapf(err, "failed to create scratch layer for %s", source)
+	}
+
+	if size != defaultScratchLayerSize {
+		if err := hcsshim.ExpandSandboxSize(di, scratchDir, uint64(size)); err != nil {
+			hcsshim.DestroyLayer(di, scratchDir)
+			return "", errors.Wrapf(err, "failed to set scratch layer size to %d bytes", size)
+		}
+	}
+
+	if err := activateAndPrepareLayer(di, scratchDir, []string{source}); err != nil {
+		hcsshim.DestroyLayer(di, scratchDir)
+		return "", err
+	}
+
+	mountPath, err := hcsshim.GetLayerMountPath(di, scratchDir)
+	if err != nil {
+		unmountReadOnlyLayer(source, token)
+		return "", errors.Wrapf(err, "failed to get mount path for scratch layer %s", scratchDir)
+	}
+
+	lm.target = mountPath
+	return lm.target, nil
+}
+
+// unmountReadOnlyLayer reverses mountReadOnlyLayer for the scratch layer
+// derived from source and token, via the same idempotent unprepare/
+// deactivate chain used for ordinary windows-layer mounts, then destroys
+// the scratch layer.
+func unmountReadOnlyLayer(source, token string) error {
+	scratchDir := readOnlyScratchLayerPath(source, token)
+	if err := unmountWindowsLayer(scratchDir); err != nil {
+		return err
+	}
+
+	di := hcsshim.DriverInfo{}
+	if err := hcsshim.DestroyLayer(di, scratchDir); err != nil {
+		return errors.Wrapf(err, "failed to destroy scratch layer %s", scratchDir)
+	}
+
+	return nil
+}
+
+// readOnlyScratchLayerPath derives the scratch layer directory for a
+// read-only mount of source. token is a random value unique to this Mount
+// call, recorded in the mount's Options so Unmount can recompute the same
+// path from lm.mounts without localMounter needing extra state of its own;
+// it keeps two concurrent read-only mounts of the same source from landing
+// on the same scratch directory.
+func readOnlyScratchLayerPath(source, token string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + token))
+	dir := ScratchLayerDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("buildkit-ro-%x", sum[:8]))
+}
+
+// scratchTokenFlag is the mount option prefix used to record the random
+// token identifying a read-only mount's scratch layer, so Unmount can
+// recompute its path from lm.mounts alone.
+const scratchTokenFlag = "scratchToken="
+
+// newScratchToken generates a random token to disambiguate this Mount
+// call's scratch layer from any other concurrent read-only mount of the
+// same source.
+func newScratchToken() (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// scratchTokenFromOptions extracts the scratch layer token previously
+// recorded in options by Mount, if any.
+func scratchTokenFromOptions(options []string) string {
+	for _, opt := range options {
+		if strings.HasPrefix(opt, scratchTokenFlag) {
+			return strings.TrimPrefix(opt, scratchTokenFlag)
+		}
+	}
+	return ""
+}
+
+// isReadOnlyBindMount reports whether m is a bind/rbind mount requesting a
+// read-only view, the kind mountReadOnlyLayer handles.
+func isReadOnlyBindMount(m mount.Mount) bool {
+	if m.Type != "bind" && m.Type != "rbind" {
+		return false
+	}
+	for _, opt := range m.Options {
+		if opt == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// activateAndPrepareLayer activates and prepares layerPath with hcsshim,
+// recording the attempt in a lockfile inside the layer directory before
+// doing anything else so a crash mid-mount leaves evidence for a later
+// Unmount to clean up.
+func activateAndPrepareLayer(di hcsshim.DriverInfo, layerPath string, parentLayerPaths []string) (err error) {
+	lockPath := filepath.Join(layerPath, mountLockFile)
+	if err := ioutil.WriteFile(lockPath, []byte{}, 0600); err != nil {
+		return errors.Wrap(err, "failed to create mount lockfile")
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(lockPath)
+		}
+	}()
+
+	if err := hcsshim.ActivateLayer(di, layerPath); err != nil {
+		return errors.Wrapf(err, "failed to activate layer %s", layerPath)
+	}
+	defer func() {
+		if err != nil {
+			hcsshim.DeactivateLayer(di, layerPath)
+		}
+	}()
+
+	if err := hcsshim.PrepareLayer(di, layerPath, parentLayerPaths); err != nil {
+		return errors.Wrapf(err, "failed to prepare layer %s", layerPath)
+	}
+
+	return nil
+}
+
+// unmountWindowsLayer reverses activateAndPrepareLayer. It is idempotent:
+// if the lockfile is already gone, either this layer was never mounted or
+// a previous call already completed the teardown, so there is nothing to
+// do. This lets Unmount be called again after a process crash that left
+// the layer activated but never got to tear it down.
+func unmountWindowsLayer(layerPath string) error {
+	lockPath := filepath.Join(layerPath, mountLockFile)
+	if _, err := os.Stat(lockPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	di := hcsshim.DriverInfo{}
+	if err := hcsshim.UnprepareLayer(di, layerPath); err != nil {
+		return errors.Wrapf(err, "failed to unprepare layer %s", layerPath)
+	}
+	if err := hcsshim.DeactivateLayer(di, layerPath); err != nil {
+		return errors.Wrapf(err, "failed to deactivate layer %s", layerPath)
+	}
+
+	return os.Remove(lockPath)
+}
+
+// parentLayerPathsFromOptions extracts the ordered (lowest to highest)
+// parent layer paths encoded by the windows snapshotter in m.Options, if
+// any are present.
+func parentLayerPathsFromOptions(options []string) ([]string, error) {
+	for _, opt := range options {
+		if !strings.HasPrefix(opt, parentLayerPathsFlag) {
+			continue
+		}
+		var paths []string
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(opt, parentLayerPathsFlag)), &paths); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal parent layer paths")
+		}
+		return paths, nil
+	}
+	return nil, nil
+}
+
 func (lm *localMounter) Unmount() error {
 	lm.mu.Lock()
 	defer lm.mu.Unlock()
 
 	if lm.target != "" {
-		if err := mount.Unmount(lm.target, 0); err != nil {
-			return err
+		switch {
+		case isWindowsLayerChain(lm.mounts):
+			top := lm.mounts[len(lm.mounts)-1]
+			if err := unmountWindowsLayer(top.Source); err != nil {
+				return err
+			}
+		case len(lm.mounts) == 1 && isReadOnlyBindMount(lm.mounts[0]):
+			token := scratchTokenFromOptions(lm.mounts[0].Options)
+			if err := unmountReadOnlyLayer(lm.mounts[0].Source, token); err != nil {
+				return err
+			}
+		default:
+			if err := mount.Unmount(lm.target, 0); err != nil {
+				return err
+			}
+			os.RemoveAll(lm.target)
 		}
-		os.RemoveAll(lm.target)
 		lm.target = ""
 	}
 
@@ -0,0 +1,342 @@
+// +build windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package winlayer started as a polyfill of containerd's internal/ociwclayer
+// package (itself based on hcsshim's internal/ociwclayer), vendored and then
+// forked to add the base-layer, tar-split, and foreign-layer support
+// buildkit's Windows snapshotter needs that neither upstream package has.
+// Because of that divergence it lives here rather than under vendor/, where
+// a `go mod vendor` refresh would overwrite it; reconciling with upstream
+// (or upstreaming these additions) is still open work.
+//
+// Nothing in the tree calls into this package yet - the windows snapshotter
+// wiring is a follow-up - so ImportLayer/ImportBaseLayer/ExportLayer take
+// their optional behaviours as a single ImportLayerOptions/ExportLayerOptions
+// struct each, settled as of the foreign-layer support. Once a real caller
+// lands, grow those structs instead of changing the positional signature
+// again.
+//
+// In particular, nothing yet drives ImportLayerOptions.MetadataWriter or
+// ExportLayerOptions.MetadataReader from the windows snapshotter, so the
+// stable content-addressed diff digests they exist to produce aren't
+// actually available to a real build until that snapshotter file threads
+// a layer's tar-split metadata blob from import through to export. Treat
+// that wiring as the remaining half of the work, not as done.
+package winlayer
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Microsoft/go-winio/backuptar"
+	"github.com/Microsoft/hcsshim"
+	"github.com/docker/distribution"
+	"github.com/pkg/errors"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// ExportLayerOptions holds the optional behaviours of ExportLayer and
+// ExportBaseLayer.
+type ExportLayerOptions struct {
+	// MetadataReader, if set, is read as the tar-split metadata blob
+	// produced by the ImportLayer call that created this layer, and the
+	// tar stream is reassembled from it byte-for-byte instead of being
+	// re-encoded from the on-disk files, so content-addressed callers see
+	// a stable digest across import/export round-trips.
+	MetadataReader io.Reader
+
+	// ForeignSources lists known foreign layer descriptors this export
+	// may match against, e.g. the set advertised for the Windows release
+	// being built against.
+	ForeignSources []distribution.Descriptor
+
+	// MatchForeignSource, required when ForeignSources is non-empty, is
+	// given the path being exported and reports which entry, if any, it
+	// matches. MatchSharedBaseImage is the usual implementation, matching
+	// via hcsshim.GetSharedBaseImages.
+	MatchForeignSource func(path string, foreignSources []distribution.Descriptor) (*distribution.Descriptor, error)
+
+	// ForeignDescriptorWriter, when a ForeignSources match is found,
+	// receives the matched descriptor JSON-encoded, so the caller can
+	// emit a non-distributable manifest entry pointing at its URLs
+	// instead of pushing the layer's bytes.
+	ForeignDescriptorWriter io.Writer
+}
+
+// ExportLayer writes an OCI layer tar stream from the provided on-disk layer.
+// The caller must specify the parent layers, if any, ordered from lowest to
+// highest layer.
+//
+// If opts.ForeignSources matches this layer, ExportLayer skips streaming
+// file content and writes only the layer's whiteout/tombstone entries,
+// describing the matched foreign descriptor to opts.ForeignDescriptorWriter
+// instead. See ExportLayerOptions for its other optional behaviours.
+//
+// The layer will be mounted for this process, so the caller should ensure that
+// it is not currently mounted.
+// Workalike for github.com/Microsoft/hcsshim/internal/ociwclayer ExportLayer
+func ExportLayer(ctx context.Context, w io.Writer, path string, parentLayerPaths []string, opts ExportLayerOptions) error {
+	// Based on github.com/Microsoft/hcsshim/internal/ociwclayer/export.go
+	var driverInfo = hcsshim.DriverInfo{}
+
+	err := hcsshim.ActivateLayer(driverInfo, path)
+	if err != nil {
+		return err
+	}
+	defer hcsshim.DeactivateLayer(driverInfo, path)
+
+	// Prepare and unprepare the layer to ensure that it has been initialized.
+	err = hcsshim.PrepareLayer(driverInfo, path, parentLayerPaths)
+	if err != nil {
+		return err
+	}
+	err = hcsshim.UnprepareLayer(driverInfo, path)
+	if err != nil {
+		return err
+	}
+
+	foreign, err := matchForeignSource(path, opts)
+	if err != nil {
+		return err
+	}
+
+	r, err := hcsshim.NewLayerReader(driverInfo, path, parentLayerPaths)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case foreign != nil:
+		if opts.ForeignDescriptorWriter != nil {
+			if jerr := json.NewEncoder(opts.ForeignDescriptorWriter).Encode(foreign); jerr != nil {
+				r.Close()
+				return errors.Wrap(jerr, "failed to write foreign layer descriptor")
+			}
+		}
+		err = writeWhiteoutsFromLayer(ctx, r, w)
+	case opts.MetadataReader != nil:
+		err = writeTarFromLayerWithMetadata(ctx, r, w, opts.MetadataReader)
+	default:
+		err = writeTarFromLayer(ctx, r, w)
+	}
+	cerr := r.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// ExportBaseLayer writes an OCI layer tar stream for a Windows base (OS)
+// layer - one containing a Files/ tree, a Hives/ tree, and optionally a
+// UtilityVM/ image. hcsshim's layer reader already walks those trees the
+// same way it walks an ordinary sandbox layer, so this is ExportLayer under
+// a name that makes the caller's intent explicit for anything downstream
+// that only applies to base layers, such as matching against a foreign
+// layer descriptor.
+func ExportBaseLayer(ctx context.Context, w io.Writer, path string, parentLayerPaths []string, opts ExportLayerOptions) error {
+	return ExportLayer(ctx, w, path, parentLayerPaths, opts)
+}
+
+// matchForeignSource reports which, if any, of opts.ForeignSources the
+// layer at path matches, or nil if opts.ForeignSources is empty.
+func matchForeignSource(path string, opts ExportLayerOptions) (*distribution.Descriptor, error) {
+	if len(opts.ForeignSources) == 0 {
+		return nil, nil
+	}
+	if opts.MatchForeignSource == nil {
+		return nil, errors.New("ExportLayerOptions.ForeignSources set without a MatchForeignSource func")
+	}
+	return opts.MatchForeignSource(path, opts.ForeignSources)
+}
+
+// MatchSharedBaseImage is the usual ExportLayerOptions.MatchForeignSource
+// implementation. It calls hcsshim.GetSharedBaseImages to enumerate the OS
+// base images already registered on this host, and reports a
+// foreignSources entry as a match once it finds a shared base image whose
+// Files/ root is the same on-disk directory as path's and whose
+// BaseImageLayerID equals that entry's digest.
+func MatchSharedBaseImage(path string, foreignSources []distribution.Descriptor) (*distribution.Descriptor, error) {
+	images, err := hcsshim.GetSharedBaseImages()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to enumerate shared base images")
+	}
+
+	for _, img := range images {
+		same, err := sameDirectory(filepath.Join(img.Path, "Files"), filepath.Join(path, "Files"))
+		if err != nil || !same {
+			continue
+		}
+		for i := range foreignSources {
+			if foreignSources[i].Digest.String() == img.BaseImageLayerID {
+				return &foreignSources[i], nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// sameDirectory reports whether a and b refer to the same on-disk
+// directory.
+func sameDirectory(a, b string) (bool, error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, nil
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, nil
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+// writeWhiteoutsFromLayer writes just the whiteout/tombstone entries of the
+// layer read from r, skipping real file content for layers whose bytes are
+// available elsewhere - namely a matched foreign layer's URLs.
+func writeWhiteoutsFromLayer(ctx context.Context, r hcsshim.LayerReader, w io.Writer) error {
+	t := tar.NewWriter(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		name, _, fileInfo, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if fileInfo != nil {
+			continue
+		}
+		hdr := &tar.Header{
+			Name: filepath.ToSlash(filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))),
+		}
+		if err := t.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	return t.Close()
+}
+
+// Forked from github.com/Microsoft/hcsshim/internal/ociwclayer/export.go
+// ctx added so we can abort early.
+func writeTarFromLayer(ctx context.Context, r hcsshim.LayerReader, w io.Writer) error {
+	t := tar.NewWriter(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		name, size, fileInfo, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if fileInfo == nil {
+			// Write a whiteout file.
+			hdr := &tar.Header{
+				Name: filepath.ToSlash(filepath.Join(filepath.Dir(name), whiteoutPrefix+filepath.Base(name))),
+			}
+			err := t.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+		} else {
+			err = backuptar.WriteTarFileFromBackupStream(t, r, name, size, fileInfo)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return t.Close()
+}
+
+// writeTarFromLayerWithMetadata reassembles the tar stream originally
+// consumed by ImportLayer, using the tar-split metadata it recorded - every
+// raw header and inter-file padding byte - to drive the framing, and r to
+// supply each entry's file payload in the same order ImportLayer read them.
+func writeTarFromLayerWithMetadata(ctx context.Context, r hcsshim.LayerReader, w io.Writer, metadataReader io.Reader) error {
+	rc := asm.NewOutputTarStream(&layerReaderFileGetter{ctx: ctx, r: r}, storage.NewJSONUnpacker(metadataReader))
+	defer rc.Close()
+
+	_, err := io.Copy(w, rc)
+	return err
+}
+
+// layerReaderFileGetter adapts a hcsshim.LayerReader, which only yields its
+// entries in order via Next, to tar-split's storage.FileGetter interface.
+// asm.NewOutputTarStream calls Get once per entry with a non-empty payload,
+// in the order recorded in the metadata, which is the same order ImportLayer
+// originally read the entries in. Get advances r.Next() past whiteouts and
+// zero-size entries (which asm never asks for) to the next entry with
+// content, keeping the two in lockstep regardless of the filename asm asks
+// for.
+type layerReaderFileGetter struct {
+	ctx context.Context
+	r   hcsshim.LayerReader
+}
+
+func (g *layerReaderFileGetter) Get(filename string) (io.ReadCloser, error) {
+	select {
+	case <-g.ctx.Done():
+		return nil, g.ctx.Err()
+	default:
+	}
+
+	name, size, fileInfo, err := g.r.Next()
+	for err == nil && (fileInfo == nil || size == 0) {
+		name, size, fileInfo, err = g.r.Next()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// WriteTarFileFromBackupStream is the only code that knows how to turn
+	// this entry's Win32 backup stream into plain file bytes; route through
+	// a throwaway one-entry tar so we can hand asm just the payload and let
+	// the recorded metadata own the header framing.
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := backuptar.WriteTarFileFromBackupStream(tw, g.r, name, size, fileInfo)
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	tr := tar.NewReader(pr)
+	if _, err := tr.Next(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(tr), nil
+}
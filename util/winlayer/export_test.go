@@ -0,0 +1,138 @@
+// +build windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package winlayer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Microsoft/go-winio"
+	"github.com/Microsoft/go-winio/backuptar"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// fakeLayerEntry is one file recorded while replaying a tar stream through
+// backuptar the way importLayer originally consumed it.
+type fakeLayerEntry struct {
+	name       string
+	size       int64
+	fileInfo   *winio.FileBasicInfo
+	backupData []byte
+}
+
+// fakeLayerReader replays a fixed sequence of entries the way hcsshim's real
+// LayerReader does during export, in whatever order it was constructed with.
+// layerReaderFileGetter.Get is only correct if that order matches the order
+// the tar-split metadata was recorded in during import; it ignores the
+// filename it's asked for entirely.
+type fakeLayerReader struct {
+	entries []fakeLayerEntry
+	pos     int
+	cur     *bytes.Reader
+}
+
+func (f *fakeLayerReader) Next() (string, int64, *winio.FileBasicInfo, error) {
+	if f.pos >= len(f.entries) {
+		return "", 0, nil, io.EOF
+	}
+	e := f.entries[f.pos]
+	f.pos++
+	f.cur = bytes.NewReader(e.backupData)
+	return e.name, e.size, e.fileInfo, nil
+}
+
+func (f *fakeLayerReader) Read(p []byte) (int, error) {
+	if f.cur == nil {
+		return 0, io.EOF
+	}
+	return f.cur.Read(p)
+}
+
+func (f *fakeLayerReader) Close() error { return nil }
+
+// TestLayerReaderFileGetterRoundTrip packs a tar stream's metadata the way
+// importLayer does, replays its files through a fakeLayerReader in the same
+// order they were originally packed, and checks writeTarFromLayerWithMetadata
+// reproduces the original tar byte-for-byte - the property a stable
+// content-addressed diff digest depends on.
+func TestLayerReaderFileGetterRoundTrip(t *testing.T) {
+	var original bytes.Buffer
+	tw := tar.NewWriter(&original)
+	files := []struct {
+		name string
+		body string
+	}{
+		{"a.txt", "hello"},
+		{"sub/b.txt", "world, a bit longer than the first file"},
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%s): %v", f.name, err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			t.Fatalf("Write(%s): %v", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+
+	var metadata bytes.Buffer
+	packed, err := asm.NewInputTarStream(bytes.NewReader(original.Bytes()), storage.NewJSONPacker(&metadata), storage.NewDiscardFilePutter())
+	if err != nil {
+		t.Fatalf("NewInputTarStream: %v", err)
+	}
+
+	var entries []fakeLayerEntry
+	tr := tar.NewReader(packed)
+	hdr, nextErr := tr.Next()
+	for nextErr != io.EOF {
+		if nextErr != nil {
+			t.Fatalf("tar Next: %v", nextErr)
+		}
+		name, size, fileInfo, err := backuptar.FileInfoFromHeader(hdr)
+		if err != nil {
+			t.Fatalf("FileInfoFromHeader(%s): %v", hdr.Name, err)
+		}
+		var backupData bytes.Buffer
+		hdr, nextErr = backuptar.WriteBackupStreamFromTarFile(&backupData, tr, hdr)
+		entries = append(entries, fakeLayerEntry{name: name, size: size, fileInfo: fileInfo, backupData: backupData.Bytes()})
+	}
+	// Drain the packed stream, as importLayer does, so the packer has
+	// recorded the trailing end-of-archive blocks before metadata is used.
+	if _, err := io.Copy(ioutil.Discard, packed); err != nil {
+		t.Fatalf("draining packed stream: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = writeTarFromLayerWithMetadata(context.Background(), &fakeLayerReader{entries: entries}, &out, bytes.NewReader(metadata.Bytes()))
+	if err != nil {
+		t.Fatalf("writeTarFromLayerWithMetadata: %v", err)
+	}
+
+	if !bytes.Equal(out.Bytes(), original.Bytes()) {
+		t.Fatalf("reassembled tar does not match original byte-for-byte: got %d bytes, want %d", out.Len(), original.Len())
+	}
+}
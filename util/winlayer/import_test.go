@@ -0,0 +1,111 @@
+// +build windows
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package winlayer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type nopCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (c *nopCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDigestVerifyingReadCloserMatches(t *testing.T) {
+	content := []byte("this is the content of a foreign layer blob")
+	want := digest.FromBytes(content)
+
+	rc := &nopCloser{Reader: bytes.NewReader(content)}
+	verifier := want.Verifier()
+	d := &digestVerifyingReadCloser{
+		r:        io.TeeReader(rc, verifier),
+		c:        rc,
+		verifier: verifier,
+		digest:   want,
+	}
+
+	got, err := ioutil.ReadAll(d)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("read content mismatch: got %q, want %q", got, content)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !rc.closed {
+		t.Fatal("Close did not reach the underlying io.Closer")
+	}
+}
+
+func TestDigestVerifyingReadCloserMismatch(t *testing.T) {
+	content := []byte("actual content served by the remote host")
+	wrong := digest.FromBytes([]byte("a different blob entirely"))
+
+	rc := &nopCloser{Reader: bytes.NewReader(content)}
+	verifier := wrong.Verifier()
+	d := &digestVerifyingReadCloser{
+		r:        io.TeeReader(rc, verifier),
+		c:        rc,
+		verifier: verifier,
+		digest:   wrong,
+	}
+
+	_, err := ioutil.ReadAll(d)
+	if err == nil {
+		t.Fatal("expected a digest mismatch error, got nil")
+	}
+}
+
+func TestDigestVerifyingReadCloserShortRead(t *testing.T) {
+	content := []byte("a blob that the caller stops reading before EOF")
+	want := digest.FromBytes(content)
+
+	rc := &nopCloser{Reader: bytes.NewReader(content)}
+	verifier := want.Verifier()
+	d := &digestVerifyingReadCloser{
+		r:        io.TeeReader(rc, verifier),
+		c:        rc,
+		verifier: verifier,
+		digest:   want,
+	}
+
+	buf := make([]byte, 4)
+	if _, err := d.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	// Not reaching EOF at all means Read never gets the chance to check the
+	// verifier, so no error is raised here - the caller is responsible for
+	// reading to completion if it wants the check to run.
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}